@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fastjson"
+)
+
+// backendHealth is one entry from `varnishadm backend.list -j -p`.
+type backendHealth struct {
+	name      string
+	director  string
+	vcl       string
+	up        bool
+	lastBits  int64
+	window    int64
+	good      int64
+	threshold int64
+}
+
+// collectBackendHealthNamed asks varnishadm for backend state and
+// director probe windows. VBE.* counters from varnishstat only show
+// traffic; this is the only signal for whether a director has marked a
+// backend sick. Respects -no-admin by returning no entries (callers skip
+// the collector entirely when noAdmin is set, same as listVCLNamed).
+func collectBackendHealthNamed(instanceName string) ([]backendHealth, error) {
+	args := []string{"backend.list", "-j", "-p"}
+	if instanceName != "" {
+		args = append([]string{"-n", instanceName}, args...)
+	}
+	out, err := execute("varnishadm", args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseBackendList(out)
+}
+
+// parseBackendList decodes the v3 JSON shape used by backend.list since
+// Varnish 6.5: a header array ([version, timestamp]) followed by one
+// object per backend.
+func parseBackendList(input string) ([]backendHealth, error) {
+	val, err := fastjson.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := val.Array()
+	if err != nil {
+		return nil, err
+	}
+	if len(arr) < 2 {
+		return nil, fmt.Errorf("backend.list: unexpected output shape")
+	}
+
+	result := make([]backendHealth, 0, len(arr)-2)
+	for _, v := range arr[2:] {
+		name := string(v.GetStringBytes("backend"))
+		vclName, director := splitBackendName(name)
+
+		probe := v.Get("probe")
+		h := backendHealth{
+			name:     name,
+			director: director,
+			vcl:      vclName,
+			up:       string(v.GetStringBytes("admin_health")) != "sick" && string(v.GetStringBytes("probe_message")) != "Sick",
+		}
+		if probe != nil {
+			h.lastBits = probe.GetInt64("last")
+			h.window = probe.GetInt64("window")
+			h.good = probe.GetInt64("happy")
+			h.threshold = probe.GetInt64("threshold")
+		}
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+// splitBackendName pulls the VCL name and director-local backend name out
+// of the "vclname.director.backend"-ish identifier backend.list reports,
+// matching the VBE.<vcl>.<backend>.<counter> layout genMetrics already
+// parses.
+func splitBackendName(full string) (vcl, director string) {
+	idx := bytes.IndexByte([]byte(full), '.')
+	if idx < 0 {
+		return "", full
+	}
+	return full[:idx], full[idx+1:]
+}
+
+// renderBackendHealth appends backend health gauges in the same hand-built
+// exposition format genMetrics uses for the varnishstat-derived metrics.
+func renderBackendHealth(w *bytes.Buffer, backends []backendHealth) {
+	w.WriteString("# HELP varnish_backend_up Whether the director considers this backend healthy\n")
+	w.WriteString("# TYPE varnish_backend_up gauge\n")
+	w.WriteString("# HELP varnish_backend_probe_last_bits Bitmap of the last probe results\n")
+	w.WriteString("# TYPE varnish_backend_probe_last_bits gauge\n")
+	w.WriteString("# HELP varnish_backend_probe_window Number of probes kept in the health window\n")
+	w.WriteString("# TYPE varnish_backend_probe_window gauge\n")
+	w.WriteString("# HELP varnish_backend_probe_good Number of good probes in the health window\n")
+	w.WriteString("# TYPE varnish_backend_probe_good gauge\n")
+	w.WriteString("# HELP varnish_backend_probe_threshold Probes required to be healthy in the window\n")
+	w.WriteString("# TYPE varnish_backend_probe_threshold gauge\n")
+
+	for _, b := range backends {
+		labels := formatLabel(map[string]string{
+			"name":     b.name,
+			"director": b.director,
+			"vcl":      b.vcl,
+		})
+		up := 0
+		if b.up {
+			up = 1
+		}
+		w.WriteString(fmt.Sprintf("varnish_backend_up%s %d\n", labels, up))
+		w.WriteString(fmt.Sprintf("varnish_backend_probe_last_bits%s %d\n", labels, b.lastBits))
+		w.WriteString(fmt.Sprintf("varnish_backend_probe_window%s %d\n", labels, b.window))
+		w.WriteString(fmt.Sprintf("varnish_backend_probe_good%s %d\n", labels, b.good))
+		w.WriteString(fmt.Sprintf("varnish_backend_probe_threshold%s %d\n", labels, b.threshold))
+	}
+}
+
+var (
+	backendLabelNames         = []string{"name", "director", "vcl"}
+	backendUpDesc             = prometheus.NewDesc("varnish_backend_up", "Whether the director considers this backend healthy", backendLabelNames, nil)
+	backendProbeLastBitsDesc  = prometheus.NewDesc("varnish_backend_probe_last_bits", "Bitmap of the last probe results", backendLabelNames, nil)
+	backendProbeWindowDesc    = prometheus.NewDesc("varnish_backend_probe_window", "Number of probes kept in the health window", backendLabelNames, nil)
+	backendProbeGoodDesc      = prometheus.NewDesc("varnish_backend_probe_good", "Number of good probes in the health window", backendLabelNames, nil)
+	backendProbeThresholdDesc = prometheus.NewDesc("varnish_backend_probe_threshold", "Probes required to be healthy in the window", backendLabelNames, nil)
+)
+
+// collectBackendHealthPrometheus is the typed-descriptor counterpart to
+// renderBackendHealth, used by promCollector so -exposition=prometheus
+// gets the same backend-health gauges as the legacy text path.
+func collectBackendHealthPrometheus(ch chan<- prometheus.Metric, backends []backendHealth) {
+	for _, b := range backends {
+		up := 0.0
+		if b.up {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, up, b.name, b.director, b.vcl)
+		ch <- prometheus.MustNewConstMetric(backendProbeLastBitsDesc, prometheus.GaugeValue, float64(b.lastBits), b.name, b.director, b.vcl)
+		ch <- prometheus.MustNewConstMetric(backendProbeWindowDesc, prometheus.GaugeValue, float64(b.window), b.name, b.director, b.vcl)
+		ch <- prometheus.MustNewConstMetric(backendProbeGoodDesc, prometheus.GaugeValue, float64(b.good), b.name, b.director, b.vcl)
+		ch <- prometheus.MustNewConstMetric(backendProbeThresholdDesc, prometheus.GaugeValue, float64(b.threshold), b.name, b.director, b.vcl)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSplitBackendName(t *testing.T) {
+	cases := []struct {
+		full         string
+		wantVCL      string
+		wantDirector string
+	}{
+		{"boot.default", "boot", "default"},
+		{"boot.director.backend1", "boot", "director.backend1"},
+		{"nodot", "", "nodot"},
+	}
+	for _, c := range cases {
+		vcl, director := splitBackendName(c.full)
+		if vcl != c.wantVCL || director != c.wantDirector {
+			t.Errorf("splitBackendName(%q) = (%q, %q), want (%q, %q)", c.full, vcl, director, c.wantVCL, c.wantDirector)
+		}
+	}
+}
+
+func TestParseBackendList(t *testing.T) {
+	input := `[4, 1700000000, {"backend": "boot.default", "admin_health": "healthy", "probe_message": "Good", "probe": {"last": 63, "window": 8, "happy": 8, "threshold": 3}}, {"backend": "boot.sick", "admin_health": "sick", "probe_message": "Sick"}]`
+
+	backends, err := parseBackendList(input)
+	if err != nil {
+		t.Fatalf("parseBackendList: %v", err)
+	}
+	if len(backends) != 2 {
+		t.Fatalf("got %d backends, want 2", len(backends))
+	}
+
+	up := backends[0]
+	if up.name != "boot.default" || up.vcl != "boot" || up.director != "default" {
+		t.Errorf("backends[0] = %+v, unexpected name/vcl/director", up)
+	}
+	if !up.up {
+		t.Error("backends[0].up = false, want true")
+	}
+	if up.window != 8 || up.good != 8 || up.threshold != 3 || up.lastBits != 63 {
+		t.Errorf("backends[0] probe fields = %+v, unexpected values", up)
+	}
+
+	sick := backends[1]
+	if sick.up {
+		t.Error("backends[1].up = true, want false (admin_health sick)")
+	}
+}
+
+func TestParseBackendListRejectsShortInput(t *testing.T) {
+	if _, err := parseBackendList(`[4]`); err == nil {
+		t.Fatal("expected error for header-only input, got nil")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the static multi-instance file: a list of varnishd instance
+// names (the argument each would get passed to -n) to pre-warm at
+// startup, in addition to whatever the /probe?target= query parameter
+// requests on demand.
+type Config struct {
+	Instances []string `yaml:"instances"`
+
+	// AllowList/DenyList bound the cardinality of the prometheus.Collector
+	// exposition path (-exposition=prometheus). An empty AllowList means
+	// "allow everything not explicitly denied".
+	AllowList []string `yaml:"allow_list"`
+	DenyList  []string `yaml:"deny_list"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// exporter is a single Varnish instance's collector set: the counter
+// source (exec or vsm), the optional VSL tailer, and the admin-derived
+// collectors (VCL discovery, backend health). collectMetrics used to be a
+// package-level function closing over global flags; instance-scoped
+// exporters are what let /probe run a scrape against an arbitrary
+// instance name instead of whatever -n was passed at startup.
+type exporter struct {
+	name          string
+	noAdmin       bool
+	collectorKind string
+	vslLabels     []string
+
+	lastUsed int64 // unix nanos, touched on every get(); see exporterRegistry eviction
+
+	mu        sync.Mutex
+	stats     statsCollector
+	vsl       *vslCollector
+	prom      *promCollector
+	reloader  *reloader
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newExporter(name string, collectorKind string, noAdmin bool, vslLabels []string) *exporter {
+	return &exporter{
+		name:          name,
+		noAdmin:       noAdmin,
+		collectorKind: collectorKind,
+		vslLabels:     vslLabels,
+		stop:          make(chan struct{}),
+	}
+}
+
+// touch records that this exporter just served a request, so
+// exporterRegistry's on-demand eviction can find the least recently used
+// entry.
+func (e *exporter) touch() {
+	atomic.StoreInt64(&e.lastUsed, time.Now().UnixNano())
+}
+
+// close stops this exporter's VSL tailer goroutine (if any). Safe to call
+// more than once and safe to call on an exporter whose tailer never
+// started. Used by exporterRegistry to actually free the goroutine an
+// evicted on-demand instance was holding onto.
+func (e *exporter) close() {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+	})
+}
+
+// ensureStarted lazily opens the stats collector and, if configured,
+// starts the VSL tailer goroutine. Deferred to first scrape so /probe can
+// construct exporters on demand without paying the VSM-open/varnishlog
+// fork cost for instances that are never actually scraped.
+func (e *exporter) ensureStarted() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stats == nil {
+		stats, err := newStatsCollector(e.collectorKind, e.name)
+		if err != nil {
+			return err
+		}
+		e.stats = stats
+	}
+	if e.vsl == nil && e.vslLabels != nil {
+		e.vsl = newVSLCollector(e.vslLabels)
+		go e.vsl.Run(e.name, e.stop)
+	}
+	return nil
+}
+
+// promCollectorFor lazily builds the prometheus.Collector wrapping this
+// exporter, reusing it across scrapes so the *prometheus.Desc cache
+// actually pays off instead of rebuilding every request.
+func (e *exporter) promCollectorFor(allowList, denyList []string) *promCollector {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.prom == nil {
+		e.prom = newPromCollector(e, allowList, denyList)
+	}
+	return e.prom
+}
+
+// reloaderFor lazily builds the /reload driver for this instance, reused
+// across requests so its ok/fail counters and last-reload timestamp
+// persist for the collector to surface.
+func (e *exporter) reloaderFor() *reloader {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.reloader == nil {
+		e.reloader = newReloader(e.name)
+	}
+	return e.reloader
+}
+
+// collectRaw runs the stats+VCL scrape without rendering it, so callers
+// that want the structured data (the prometheus.Collector path) don't
+// have to go through the legacy text format first.
+func (e *exporter) collectRaw() (*fastjson.Object, string, error) {
+	if err := e.ensureStarted(); err != nil {
+		return nil, "", err
+	}
+
+	activeVCL, err := listVCLNamed(e.name, e.noAdmin)
+	if err != nil {
+		return nil, "", err
+	}
+	obj, err := e.stats.Collect()
+	if err != nil {
+		return nil, "", err
+	}
+	return obj, activeVCL, nil
+}
+
+func (e *exporter) Collect() (string, error) {
+	obj, activeVCL, err := e.collectRaw()
+	if err != nil {
+		return "", err
+	}
+
+	out := genMetrics(obj, activeVCL)
+
+	var w bytes.Buffer
+	if e.vsl != nil {
+		e.vsl.render(&w)
+	}
+	if !e.noAdmin {
+		backends, err := collectBackendHealthNamed(e.name)
+		if err != nil {
+			return "", err
+		}
+		renderBackendHealth(&w, backends)
+	}
+	if e.reloader != nil {
+		e.reloader.render(&w)
+	}
+	out += w.String()
+
+	if e.name != "" {
+		out = withInstanceLabel(out, e.name)
+	}
+	return out, nil
+}
+
+// withInstanceLabel stamps a varnish_instance label onto every exposed
+// sample for /probe scrapes against a non-default instance, so a single
+// Prometheus job scraping several instances through one exporter can
+// still tell them apart. It parses each line structurally (name, optional
+// {labels}, value) rather than splitting on the first space, since a
+// label value (a backend name, a VSL-extracted header) can itself
+// contain spaces.
+func withInstanceLabel(body string, instance string) string {
+	var w bytes.Buffer
+	for _, line := range splitLines(body) {
+		if line == "" || line[0] == '#' {
+			w.WriteString(line)
+			w.WriteString("\n")
+			continue
+		}
+
+		brace := strings.IndexByte(line, '{')
+		space := strings.IndexByte(line, ' ')
+		if brace < 0 || (space >= 0 && space < brace) {
+			// No existing labels: "name value".
+			if space < 0 {
+				w.WriteString(line)
+				w.WriteString("\n")
+				continue
+			}
+			w.WriteString(line[:space])
+			w.WriteString(fmt.Sprintf("{varnish_instance=\"%s\"}", instance))
+			w.WriteString(line[space:])
+			w.WriteString("\n")
+			continue
+		}
+
+		close := labelSetEnd(line, brace)
+		if close < 0 {
+			w.WriteString(line)
+			w.WriteString("\n")
+			continue
+		}
+		w.WriteString(line[:close])
+		w.WriteString(fmt.Sprintf(",varnish_instance=\"%s\"}", instance))
+		w.WriteString(line[close+1:])
+		w.WriteString("\n")
+	}
+	return w.String()
+}
+
+// labelSetEnd returns the index of the '}' that closes the label set
+// opened at line[braceIdx], skipping over '}' bytes inside quoted label
+// values.
+func labelSetEnd(line string, braceIdx int) int {
+	inQuote, escaped := false, false
+	for i := braceIdx + 1; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case !inQuote && c == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+func splitLines(s string) []string {
+	var lines []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			lines = append(lines, s[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		lines = append(lines, s[start:])
+	}
+	return lines
+}
+
+// maxProbeExporters bounds how many distinct instance names /probe?target=
+// can spin up a VSL tailer/VSM mapping for at once. Instances declared via
+// -n or the config file are pinned and don't count against this cap;
+// anything else (an arbitrary ?target=) is on-demand and subject to
+// eviction once the cap is hit.
+const maxProbeExporters = 64
+
+// exporterRegistry caches one exporter per instance name so repeated
+// /probe?target= scrapes for the same instance reuse an already-open VSM
+// mapping/VSL tailer instead of re-opening them every request. Pinned
+// instances (the default -n, anything in the config file) are kept for
+// the exporter's lifetime; on-demand instances created by /probe are
+// capped at maxProbeExporters, evicting the least recently used one (and
+// stopping its VSL tailer goroutine) to make room for a new one.
+type exporterRegistry struct {
+	collectorKind string
+	noAdmin       bool
+	vslLabels     []string
+
+	mu        sync.Mutex
+	exporters map[string]*exporter
+	pinned    map[string]bool
+}
+
+func newExporterRegistry(collectorKind string, noAdmin bool, vslLabels []string) *exporterRegistry {
+	return &exporterRegistry{
+		collectorKind: collectorKind,
+		noAdmin:       noAdmin,
+		vslLabels:     vslLabels,
+		exporters:     map[string]*exporter{},
+		pinned:        map[string]bool{},
+	}
+}
+
+// get returns the exporter for an on-demand instance name, i.e. one
+// reached via /probe?target=. Subject to maxProbeExporters eviction.
+func (r *exporterRegistry) get(name string) *exporter {
+	return r.getLocked(name, false)
+}
+
+// getPinned returns the exporter for an operator-declared instance name
+// (the default -n, or one listed in the config file). Pinned exporters
+// are never evicted and don't count against maxProbeExporters.
+func (r *exporterRegistry) getPinned(name string) *exporter {
+	return r.getLocked(name, true)
+}
+
+func (r *exporterRegistry) getLocked(name string, pin bool) *exporter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pin {
+		r.pinned[name] = true
+	}
+
+	e, ok := r.exporters[name]
+	if ok {
+		e.touch()
+		return e
+	}
+
+	if !pin && r.onDemandCountLocked() >= maxProbeExporters {
+		r.evictOldestOnDemandLocked()
+	}
+
+	e = newExporter(name, r.collectorKind, r.noAdmin, r.vslLabels)
+	e.touch()
+	r.exporters[name] = e
+	return e
+}
+
+func (r *exporterRegistry) onDemandCountLocked() int {
+	n := 0
+	for name := range r.exporters {
+		if !r.pinned[name] {
+			n++
+		}
+	}
+	return n
+}
+
+// evictOldestOnDemandLocked drops the least recently used on-demand
+// exporter and stops its VSL tailer goroutine, so an attacker hitting
+// /probe?target=<random> repeatedly can't grow the exporter map or
+// goroutine count without bound.
+func (r *exporterRegistry) evictOldestOnDemandLocked() {
+	var oldestName string
+	var oldest *exporter
+	for name, e := range r.exporters {
+		if r.pinned[name] {
+			continue
+		}
+		if oldest == nil || atomic.LoadInt64(&e.lastUsed) < atomic.LoadInt64(&oldest.lastUsed) {
+			oldestName, oldest = name, e
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(r.exporters, oldestName)
+	oldest.close()
+}
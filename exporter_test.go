@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestWithInstanceLabel(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "no existing labels",
+			in:   "varnish_uptime 123\n",
+			want: "varnish_uptime{varnish_instance=\"inst1\"} 123\n",
+		},
+		{
+			name: "existing labels",
+			in:   "varnish_backend_up{name=\"default\"} 1\n",
+			want: "varnish_backend_up{name=\"default\",varnish_instance=\"inst1\"} 1\n",
+		},
+		{
+			name: "label value containing a space",
+			in:   "varnish_backend_up{name=\"my backend\"} 1\n",
+			want: "varnish_backend_up{name=\"my backend\",varnish_instance=\"inst1\"} 1\n",
+		},
+		{
+			name: "comment lines pass through untouched",
+			in:   "# HELP varnish_uptime uptime\n# TYPE varnish_uptime counter\nvarnish_uptime 1\n",
+			want: "# HELP varnish_uptime uptime\n# TYPE varnish_uptime counter\nvarnish_uptime{varnish_instance=\"inst1\"} 1\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := withInstanceLabel(c.in, "inst1")
+			if got != c.want {
+				t.Errorf("withInstanceLabel(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
@@ -52,7 +52,7 @@ func formatLabel(labels map[string]string) string {
 
 		w.WriteString(name)
 		w.WriteString("=\"")
-		w.WriteString(value)
+		w.WriteString(escapeLabelValue(value))
 		w.WriteString("\"")
 	}
 	if w.Len() > 0 {
@@ -61,7 +61,21 @@ func formatLabel(labels map[string]string) string {
 	return w.String()
 }
 
-func genMetrics(value *fastjson.Object, activeVCL string) string {
+// escapeLabelValue escapes backslash, double quote and newline the way the
+// text exposition format requires so a backend/pool/lock name containing
+// one of those characters (e.g. a backend named with a literal `"`)
+// doesn't break the output.
+func escapeLabelValue(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return replacer.Replace(value)
+}
+
+// buildMetrics walks the varnishstat JSON object into the flat []Metric
+// shape both the legacy text renderer and the prometheus.Collector
+// consume. It mirrors activeVCL defaulting to the first VBE.* vcl
+// encountered when the caller couldn't determine it via vcl.list (e.g.
+// -no-admin), same as the original genMetrics did inline.
+func buildMetrics(value *fastjson.Object, activeVCL string) ([]Metric, string) {
 	metrics := make([]Metric, 0)
 
 	value.Visit(func(key0 []byte, val *fastjson.Value) {
@@ -113,6 +127,12 @@ func genMetrics(value *fastjson.Object, activeVCL string) string {
 		}
 	})
 
+	return metrics, activeVCL
+}
+
+func genMetrics(value *fastjson.Object, activeVCL string) string {
+	metrics, activeVCL := buildMetrics(value, activeVCL)
+
 	var w bytes.Buffer
 
 	for _, m := range metrics {
@@ -143,10 +163,41 @@ func main() {
 	bind := flag.String("bind", ":9131", "binding address")
 	check := flag.Bool("check", false, "print metrics and exit")
 	noAdmin := flag.Bool("no-admin", false, "do not call 'varnishadm'")
+	collectorKind := flag.String("collector", "exec", "stats collector to use: exec|vsm")
+	instanceName := flag.String("n", "", "varnishd instance name, passed as -n to varnishstat/varnishadm")
+	vsl := flag.Bool("vsl", false, "tail varnishlog and expose per-request latency/status histograms")
+	vslLabels := flag.String("vsl-labels", "", "comma-separated whitelist of VSL-derived labels to extract (bounds cardinality)")
+	configPath := flag.String("config", "", "YAML file listing additional instances to pre-warm, see Config")
+	exposition := flag.String("exposition", "legacy", "metrics exposition to serve: legacy|prometheus")
+	reloadToken := flag.String("reload-token", "", "if set, require 'Authorization: Bearer <token>' on POST /reload")
+	watchDir := flag.String("watch", "", "directory of VCL files to watch with fsnotify and auto-reload on change")
 	flag.Parse()
 
+	var labels []string
+	if *vsl {
+		if *vslLabels != "" {
+			labels = strings.Split(*vslLabels, ",")
+		} else {
+			labels = []string{}
+		}
+	}
+
+	registry := newExporterRegistry(*collectorKind, *noAdmin, labels)
+
+	var cfg Config
+	if *configPath != "" {
+		loaded, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cfg = *loaded
+		for _, inst := range cfg.Instances {
+			registry.getPinned(inst)
+		}
+	}
+
 	if *check {
-		out, err := collectMetrics(*noAdmin)
+		out, err := registry.getPinned(*instanceName).Collect()
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -160,19 +211,38 @@ func main() {
 		w.WriteHeader(302)
 	})
 
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
-		out, err := collectMetrics(*noAdmin)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(500)
-			_, _ = w.Write([]byte(err.Error()))
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, r, registry.getPinned(*instanceName), *exposition, &cfg)
+	})
+
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte("missing ?target="))
 			return
-		} else {
-			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
-			_, _ = w.Write([]byte(out))
 		}
+		serveMetrics(w, r, registry.get(target), *exposition, &cfg)
 	})
 
+	if *noAdmin {
+		if *watchDir != "" {
+			log.Println("-watch ignored: -no-admin is set and /reload exclusively drives varnishadm")
+		}
+	} else {
+		if *reloadToken == "" {
+			log.Println("WARNING: /reload is enabled with no -reload-token; any caller that can reach this port can load and activate an arbitrary VCL file")
+		}
+
+		mux.HandleFunc("/reload", reloadHandler(registry.getPinned(*instanceName).reloaderFor(), *reloadToken))
+
+		if *watchDir != "" {
+			if err := watchVCLDir(*watchDir, registry.getPinned(*instanceName).reloaderFor()); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
 	log.Printf("Starting varnish_exporter on %s\n", *bind)
 	err := http.ListenAndServe(*bind, handlers.CombinedLoggingHandler(os.Stdout, mux))
 	if err != nil {
@@ -180,20 +250,31 @@ func main() {
 	}
 }
 
-func collectMetrics(noAdmin bool) (string, error) {
-	activeVCL, err := listVCL(noAdmin)
-	if err != nil {
-		return "", err
+// serveMetrics dispatches to the legacy hand-built text exposition or the
+// prometheus.Collector/promhttp path depending on -exposition.
+func serveMetrics(w http.ResponseWriter, r *http.Request, e *exporter, exposition string, cfg *Config) {
+	if exposition == "prometheus" {
+		servePromMetrics(w, r, e, cfg)
+		return
 	}
-	stats, err := collectStats()
+
+	out, err := e.Collect()
 	if err != nil {
-		return "", err
+		log.Println(err)
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(err.Error()))
+		return
 	}
-	return genMetrics(stats, activeVCL), nil
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(out))
 }
 
-func collectStats() (*fastjson.Object, error) {
-	out, err := execute("varnishstat", "-j", "-t", "0")
+func collectStatsExecNamed(instanceName string) (*fastjson.Object, error) {
+	args := []string{"-j", "-t", "0"}
+	if instanceName != "" {
+		args = append([]string{"-n", instanceName}, args...)
+	}
+	out, err := execute("varnishstat", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -204,11 +285,15 @@ func collectStats() (*fastjson.Object, error) {
 	return val.Object()
 }
 
-func listVCL(noAdmin bool) (string, error) {
+func listVCLNamed(instanceName string, noAdmin bool) (string, error) {
 	if noAdmin {
 		return "", nil
 	}
-	out, err := execute("varnishadm", "vcl.list", "-j")
+	args := []string{"vcl.list", "-j"}
+	if instanceName != "" {
+		args = append([]string{"-n", instanceName}, args...)
+	}
+	out, err := execute("varnishadm", args...)
 	if err != nil {
 		return "", err
 	}
@@ -244,3 +329,26 @@ func parseVCLList(input string) (string, error) {
 	}
 	return "", errors.New("No active ACL found")
 }
+
+// coolVCLNames returns the names of VCLs vcl.list -j reports as "cold"
+// with no busy reference, i.e. safe to vcl.discard.
+func coolVCLNames(input string) ([]string, error) {
+	val, err := fastjson.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	arr, err := val.Array()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, value := range arr[3:] {
+		status := string(value.GetStringBytes("status"))
+		busy := value.GetInt("busy")
+		if status == "available" && busy == 0 && string(value.GetStringBytes("state")) == "cold" {
+			names = append(names, string(value.GetStringBytes("name")))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// promCollector implements prometheus.Collector on top of an exporter,
+// replacing genMetrics's hand-built text with typed *prometheus.Desc
+// values. Going through prometheus.Registry/promhttp gets us a proper
+// HELP/TYPE registry, protobuf negotiation, OpenMetrics and correct label
+// escaping for free, instead of the fmt.Sprintf-built legacy path.
+type promCollector struct {
+	exporter *exporter
+	allow    map[string]bool
+	deny     map[string]bool
+
+	mu    sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+func newPromCollector(e *exporter, allowList, denyList []string) *promCollector {
+	return &promCollector{
+		exporter: e,
+		allow:    toSet(allowList),
+		deny:     toSet(denyList),
+		descs:    map[string]*prometheus.Desc{},
+	}
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// allowed applies the config-driven allow/deny list used to bound
+// cardinality: an empty allow list means "allow everything not denied".
+func (c *promCollector) allowed(name string) bool {
+	if len(c.allow) > 0 && !c.allow[name] {
+		return false
+	}
+	return !c.deny[name]
+}
+
+// Describe intentionally sends nothing: the set of descriptors depends on
+// which counters varnishstat reports, which isn't known until the first
+// Collect. The registry treats this as an unchecked collector.
+func (c *promCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *promCollector) Collect(ch chan<- prometheus.Metric) {
+	obj, activeVCL, err := c.exporter.collectRaw()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(
+			prometheus.NewDesc("varnish_up", "Whether the last scrape succeeded", nil, nil), err)
+		return
+	}
+
+	metrics, activeVCL := buildMetrics(obj, activeVCL)
+	for _, m := range metrics {
+		name := "varnish_" + m.Category + "_" + m.Name
+		if !c.allowed(name) {
+			continue
+		}
+
+		valueType := prometheus.CounterValue
+		if string(m.Value.GetStringBytes("flag")) == "g" {
+			valueType = prometheus.GaugeValue
+		}
+
+		labelNames, labelValues := labelNamesAndValues(m.Labels)
+		desc := c.descFor(name, string(m.Value.GetStringBytes("description")), labelNames)
+
+		ch <- prometheus.MustNewConstMetric(desc, valueType, float64(m.Value.GetInt("value")), labelValues...)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("varnish_active_vcl", "vcl version", []string{"version"}, nil),
+		prometheus.GaugeValue, 1, activeVCL,
+	)
+
+	if c.exporter.vsl != nil {
+		c.exporter.vsl.collectPrometheus(ch)
+	}
+	if !c.exporter.noAdmin {
+		backends, err := collectBackendHealthNamed(c.exporter.name)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(
+				prometheus.NewDesc("varnish_backend_up", "Whether the director considers this backend healthy", nil, nil), err)
+		} else {
+			collectBackendHealthPrometheus(ch, backends)
+		}
+	}
+
+	if c.exporter.reloader != nil {
+		r := c.exporter.reloader
+		reloadDesc := prometheus.NewDesc("varnish_vcl_reload_total", "VCL reloads triggered via /reload", []string{"result"}, nil)
+		ch <- prometheus.MustNewConstMetric(reloadDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&r.okCount)), "ok")
+		ch <- prometheus.MustNewConstMetric(reloadDesc, prometheus.CounterValue, float64(atomic.LoadUint64(&r.failCount)), "fail")
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("varnish_vcl_last_reload_timestamp_seconds", "Unix time of the last /reload attempt", nil, nil),
+			prometheus.GaugeValue, float64(atomic.LoadInt64(&r.lastUnix)),
+		)
+	}
+}
+
+// descFor lazily builds and caches the *prometheus.Desc for a counter
+// name the first time it's seen; help text and labels come from the
+// varnishstat JSON entry itself, same source genMetrics used.
+func (c *promCollector) descFor(name, help string, labelNames []string) *prometheus.Desc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d, ok := c.descs[name]; ok {
+		return d
+	}
+	d := prometheus.NewDesc(name, help, labelNames, nil)
+	c.descs[name] = d
+	return d
+}
+
+// servePromMetrics registers this exporter's promCollector on a fresh
+// prometheus.Registry and hands the request to promhttp, which takes care
+// of content-type negotiation, gzip and OpenMetrics.
+func servePromMetrics(w http.ResponseWriter, r *http.Request, e *exporter, cfg *Config) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(e.promCollectorFor(cfg.AllowList, cfg.DenyList))
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// labelNamesAndValues splits a Metric's single-entry label map (this
+// exporter never has more than one: name/type/target/pool) into the
+// parallel slices prometheus.NewDesc/MustNewConstMetric expect.
+func labelNamesAndValues(labels map[string]string) (names, values []string) {
+	for k, v := range labels {
+		names = append(names, k)
+		values = append(values, v)
+	}
+	return names, values
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestPromCollectorAllowed(t *testing.T) {
+	cases := []struct {
+		name      string
+		allowList []string
+		denyList  []string
+		metric    string
+		want      bool
+	}{
+		{"no lists allows everything", nil, nil, "varnish_main_sess_conn", true},
+		{"deny list blocks a match", nil, []string{"varnish_main_sess_conn"}, "varnish_main_sess_conn", false},
+		{"deny list leaves others alone", nil, []string{"varnish_main_sess_conn"}, "varnish_main_sess_drop", true},
+		{"allow list blocks a non-match", []string{"varnish_main_sess_conn"}, nil, "varnish_main_sess_drop", false},
+		{"allow list admits a match", []string{"varnish_main_sess_conn"}, nil, "varnish_main_sess_conn", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pc := newPromCollector(nil, c.allowList, c.denyList)
+			if got := pc.allowed(c.metric); got != c.want {
+				t.Errorf("allowed(%q) = %v, want %v", c.metric, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadRequest is the POST /reload body: the VCL file to load and an
+// optional name to load it under (defaults to the file's base name
+// without extension, so `/etc/varnish/default.vcl` becomes `default`).
+type reloadRequest struct {
+	Path string `json:"path"`
+	Name string `json:"name,omitempty"`
+}
+
+// reloader drives `varnishadm vcl.load`/`vcl.use`/`vcl.discard` the way an
+// external supervisor (e.g. a k8s sidecar watching a ConfigMap-mounted
+// VCL file) would, serializing concurrent reload attempts behind a mutex
+// and tracking the counters the collector surfaces.
+type reloader struct {
+	instanceName string
+
+	mu sync.Mutex
+
+	okCount   uint64
+	failCount uint64
+	lastUnix  int64
+}
+
+func newReloader(instanceName string) *reloader {
+	return &reloader{instanceName: instanceName}
+}
+
+// Reload loads name (or a name derived from path) from path and activates
+// it, then discards any previously-cooled VCLs so they don't pile up.
+// Concurrent callers serialize on mu so two reloads never race through
+// varnishadm at once.
+func (r *reloader) Reload(req reloadRequest) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := req.Name
+	if name == "" {
+		base := filepath.Base(req.Path)
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	var out bytes.Buffer
+
+	loadOut, err := r.admin("vcl.load", name, req.Path)
+	out.WriteString(loadOut)
+	if err != nil {
+		r.record(false)
+		return out.String(), fmt.Errorf("vcl.load %s %s: %w", name, req.Path, err)
+	}
+
+	useOut, err := r.admin("vcl.use", name)
+	out.WriteString(useOut)
+	if err != nil {
+		r.record(false)
+		return out.String(), fmt.Errorf("vcl.use %s: %w", name, err)
+	}
+
+	if discardOut, err := r.discardCooled(); err != nil {
+		out.WriteString(discardOut)
+		out.WriteString(err.Error())
+		out.WriteString("\n")
+		// A failed discard doesn't undo the load+use that already
+		// succeeded, so this reload still counts as ok.
+	} else {
+		out.WriteString(discardOut)
+	}
+
+	r.record(true)
+	return out.String(), nil
+}
+
+func (r *reloader) admin(args ...string) (string, error) {
+	if r.instanceName != "" {
+		args = append([]string{"-n", r.instanceName}, args...)
+	}
+	return execute("varnishadm", args...)
+}
+
+// discardCooled removes VCLs that have cooled down (refcount 0, not the
+// active one) so a long-running reloader sidecar doesn't leak VCL labels.
+func (r *reloader) discardCooled() (string, error) {
+	out, err := r.admin("vcl.list", "-j")
+	if err != nil {
+		return out, err
+	}
+	names, err := coolVCLNames(out)
+	if err != nil {
+		return out, err
+	}
+
+	var discardOut bytes.Buffer
+	for _, name := range names {
+		o, err := r.admin("vcl.discard", name)
+		discardOut.WriteString(o)
+		if err != nil {
+			return discardOut.String(), err
+		}
+	}
+	return discardOut.String(), nil
+}
+
+func (r *reloader) record(ok bool) {
+	if ok {
+		atomic.AddUint64(&r.okCount, 1)
+	} else {
+		atomic.AddUint64(&r.failCount, 1)
+	}
+	atomic.StoreInt64(&r.lastUnix, time.Now().Unix())
+}
+
+// render appends varnish_vcl_reload_total/varnish_vcl_last_reload_timestamp_seconds
+// in the same hand-built exposition format the other collectors use.
+func (r *reloader) render(w *bytes.Buffer) {
+	w.WriteString("# HELP varnish_vcl_reload_total VCL reloads triggered via /reload\n")
+	w.WriteString("# TYPE varnish_vcl_reload_total counter\n")
+	w.WriteString(fmt.Sprintf("varnish_vcl_reload_total{result=\"ok\"} %d\n", atomic.LoadUint64(&r.okCount)))
+	w.WriteString(fmt.Sprintf("varnish_vcl_reload_total{result=\"fail\"} %d\n", atomic.LoadUint64(&r.failCount)))
+
+	w.WriteString("# HELP varnish_vcl_last_reload_timestamp_seconds Unix time of the last /reload attempt\n")
+	w.WriteString("# TYPE varnish_vcl_last_reload_timestamp_seconds gauge\n")
+	w.WriteString(fmt.Sprintf("varnish_vcl_last_reload_timestamp_seconds %d\n", atomic.LoadInt64(&r.lastUnix)))
+}
+
+// reloadHandler is the POST /reload HTTP endpoint. If token is non-empty,
+// requests must carry a matching `Authorization: Bearer <token>` header.
+func reloadHandler(r *reloader, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !constantTimeEqual(req.Header.Get("Authorization"), "Bearer "+token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var body reloadRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Path == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("expected JSON body {\"path\": \"...\", \"name\": \"...\"}"))
+			return
+		}
+
+		out, err := r.Reload(body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "%s\n%s\n", out, err)
+			return
+		}
+		_, _ = w.Write([]byte(out))
+	}
+}
+
+// constantTimeEqual compares the Authorization header against the expected
+// bearer value in constant time so a timing side channel can't be used to
+// recover the token byte by byte.
+func constantTimeEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// watchVCLDir watches dir with fsnotify and triggers a reload using the
+// written file's own path/name whenever a VCL file inside it changes, so
+// the exporter can double as a lightweight reloader sidecar driven purely
+// by a ConfigMap/volume mount instead of the HTTP endpoint.
+func watchVCLDir(dir string, r *reloader) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				if filepath.Ext(event.Name) != ".vcl" {
+					continue
+				}
+				if _, err := r.Reload(reloadRequest{Path: event.Name}); err != nil {
+					fmt.Println("watch reload failed:", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("watch:", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "github.com/valyala/fastjson"
+
+// statsCollector is the abstraction collectStats used to hide behind a
+// single function: grab the current counter set as a *fastjson.Object so
+// genMetrics does not care whether it came from a forked varnishstat or a
+// live VSM mapping.
+type statsCollector interface {
+	Collect() (*fastjson.Object, error)
+}
+
+// execStatsCollector is the original behaviour: fork varnishstat -j on
+// every scrape. Available in every build, unlike vsmStatsCollector which
+// needs cgo and libvarnishapi-dev (see vsm.go, built only with -tags vsm).
+type execStatsCollector struct {
+	instanceName string
+}
+
+func (c execStatsCollector) Collect() (*fastjson.Object, error) {
+	return collectStatsExecNamed(c.instanceName)
+}
@@ -0,0 +1,19 @@
+//go:build !vsm
+
+package main
+
+import "fmt"
+
+// newStatsCollector is the default, cgo-free build's factory: -collector=vsm
+// needs the real implementation in vsm.go, which only exists when built with
+// -tags vsm (and requires libvarnishapi-dev to compile).
+func newStatsCollector(kind, instanceName string) (statsCollector, error) {
+	switch kind {
+	case "", "exec":
+		return execStatsCollector{instanceName: instanceName}, nil
+	case "vsm":
+		return nil, fmt.Errorf("-collector=vsm requires building with -tags vsm (and libvarnishapi-dev installed)")
+	default:
+		return nil, fmt.Errorf("unknown -collector %q, want exec|vsm", kind)
+	}
+}
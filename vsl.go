@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// execRetryDelay bounds how fast Run re-execs varnishlog after a failed
+// start (missing binary, bad -n name, ...) so a persistent failure doesn't
+// spin a CPU core.
+const execRetryDelay = 5 * time.Second
+
+// vslCollector tails `varnishlog -g request` in the background and
+// aggregates per-request timing/size data into histogram buckets so a
+// scrape only has to read already-accumulated counters, never block on
+// log I/O.
+type vslCollector struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, seconds
+
+	reqDuration     *histogram
+	backendDuration *histogram
+	responseBytes   *histogram
+	statusClass     *labeledCounter
+	cacheResult     *labeledCounter
+
+	// labelWhitelist maps the lowercased VSL header name (as it appears
+	// after "ReqHeader "/"RespHeader ") to the Prometheus label name it is
+	// extracted under.
+	labelWhitelist map[string]string
+	// labelNames is labelWhitelist's values, sorted once so every counter
+	// emitted by collectPrometheus carries the same fixed label set.
+	labelNames []string
+
+	reqDurationDesc     *prometheus.Desc
+	backendDurationDesc *prometheus.Desc
+	responseBytesDesc   *prometheus.Desc
+	statusDesc          *prometheus.Desc
+	cacheResultDesc     *prometheus.Desc
+}
+
+// labeledCounter is a counter partitioned by one fixed dimension (a status
+// class, a cache result) plus whatever extra labels were extracted from
+// the whitelist for that request.
+type labeledCounter struct {
+	counts map[counterKey]*counterEntry
+}
+
+type counterKey struct {
+	value     string
+	labelsKey string
+}
+
+type counterEntry struct {
+	labels map[string]string
+	n      uint64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{counts: map[counterKey]*counterEntry{}}
+}
+
+func (lc *labeledCounter) inc(value string, labels map[string]string) {
+	k := counterKey{value: value, labelsKey: labelsKey(labels)}
+	e, ok := lc.counts[k]
+	if !ok {
+		e = &counterEntry{labels: labels}
+		lc.counts[k] = e
+	}
+	e.n++
+}
+
+// labelsKey builds a deterministic string from a label set so it can be
+// used as (part of) a map key regardless of range iteration order.
+func labelsKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte('\x1f')
+	}
+	return b.String()
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(nBuckets int) *histogram {
+	return &histogram{counts: make([]uint64, nBuckets)}
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.sum += v
+	h.count++
+	for i, le := range buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+}
+
+// defaultVSLBuckets mirrors Prometheus's own default latency buckets since
+// Varnish request times span the same few-ms-to-few-s range.
+var defaultVSLBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelWhitelist bounds the cardinality of extracted request labels (e.g.
+// a VCL-set X-Cache marker, or the Host header) to a small known set so a
+// misbehaving VCL can't blow up the series count.
+func newVSLCollector(labelWhitelist []string) *vslCollector {
+	allow := make(map[string]string, len(labelWhitelist))
+	names := make([]string, 0, len(labelWhitelist))
+	for _, l := range labelWhitelist {
+		name := sanitizeLabelName(l)
+		allow[strings.ToLower(l)] = name
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &vslCollector{
+		buckets:         defaultVSLBuckets,
+		reqDuration:     newHistogram(len(defaultVSLBuckets)),
+		backendDuration: newHistogram(len(defaultVSLBuckets)),
+		responseBytes:   newHistogram(len(defaultVSLBuckets)),
+		statusClass:     newLabeledCounter(),
+		cacheResult:     newLabeledCounter(),
+		labelWhitelist:  allow,
+		labelNames:      names,
+
+		reqDurationDesc:     prometheus.NewDesc("varnish_request_duration_seconds", "Request processing time, Timestamp Resp - Timestamp Start", nil, nil),
+		backendDurationDesc: prometheus.NewDesc("varnish_backend_duration_seconds", "Backend fetch time, Timestamp BerespBody - Timestamp Bereq", nil, nil),
+		responseBytesDesc:   prometheus.NewDesc("varnish_response_bytes", "Response body size from ReqAcct", nil, nil),
+		statusDesc:          prometheus.NewDesc("varnish_requests_by_status_total", "Completed requests by response status class", append([]string{"status"}, names...), nil),
+		cacheResultDesc:     prometheus.NewDesc("varnish_requests_by_cache_result_total", "Completed requests by cache hit/miss/pass", append([]string{"result"}, names...), nil),
+	}
+}
+
+// sanitizeLabelName turns a VSL header name (e.g. "X-Cache") into a valid,
+// idiomatic Prometheus label name ("x_cache").
+func sanitizeLabelName(header string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(header))
+}
+
+// Run starts tailing varnishlog and blocks until the subprocess exits or
+// stop is closed. Call it in its own goroutine; it restarts varnishlog on
+// unexpected exit.
+func (c *vslCollector) Run(instanceName string, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		args := []string{"-g", "request"}
+		if instanceName != "" {
+			args = append(args, "-n", instanceName)
+		}
+		cmd := exec.Command("varnishlog", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			log.Println("vsl:", err)
+			sleepOrStop(execRetryDelay, stop)
+			continue
+		}
+		if err := cmd.Start(); err != nil {
+			log.Println("vsl:", err)
+			sleepOrStop(execRetryDelay, stop)
+			continue
+		}
+		c.consumeReader(bufio.NewScanner(stdout))
+		_ = cmd.Wait()
+	}
+}
+
+// sleepOrStop waits out d, returning early if stop is closed, so a failing
+// varnishlog exec retries on a backoff instead of busy-looping.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) {
+	select {
+	case <-time.After(d):
+	case <-stop:
+	}
+}
+
+// Real varnishlog -g request output prefixes every record with a grouping
+// marker ("*   << Request  >> 7", "-   Timestamp    Start: ...") before the
+// tag name, so the tag is never the first non-space token on the line. All
+// tag regexes below skip that leading marker with ^\S*\s+ instead of
+// anchoring directly on the tag.
+var (
+	reTimestampResp   = regexp.MustCompile(`^\S*\s+Timestamp\s+Resp:\s+([0-9.]+)`)
+	reTimestampStart  = regexp.MustCompile(`^\S*\s+Timestamp\s+Start:\s+([0-9.]+)`)
+	reTimestampBereq  = regexp.MustCompile(`^\S*\s+Timestamp\s+Bereq:\s+([0-9.]+)`)
+	reTimestampBeresp = regexp.MustCompile(`^\S*\s+Timestamp\s+BerespBody:\s+([0-9.]+)`)
+	reRespStatus      = regexp.MustCompile(`^\S*\s+RespStatus\s+(\d+)`)
+	reReqAcct         = regexp.MustCompile(`^\S*\s+ReqAcct\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s+(\d+)`)
+	reVCLCall         = regexp.MustCompile(`^\S*\s+VCL_call\s+(\S+)`)
+	reHeader          = regexp.MustCompile(`^\S*\s+(?:Req|Resp)Header\s+([^:]+):\s?(.*)$`)
+)
+
+// record holds the fields pulled out of a single request's log transaction
+// while it is being assembled line by line.
+type record struct {
+	start, resp    float64
+	bereq, berespB float64
+	status         int
+	respBodyBytes  int64
+	cacheResult    string
+	labels         map[string]string // extracted, whitelisted header values
+}
+
+// consumeReader reads one varnishlog grouped-by-request stream, flushing a
+// record into the histograms every time a blank line ends a transaction.
+func (c *vslCollector) consumeReader(scanner *bufio.Scanner) {
+	cur := &record{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			c.flush(cur)
+			cur = &record{}
+			continue
+		}
+		if m := reTimestampStart.FindStringSubmatch(line); m != nil {
+			cur.start, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := reTimestampResp.FindStringSubmatch(line); m != nil {
+			cur.resp, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := reTimestampBereq.FindStringSubmatch(line); m != nil {
+			cur.bereq, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := reTimestampBeresp.FindStringSubmatch(line); m != nil {
+			cur.berespB, _ = strconv.ParseFloat(m[1], 64)
+		} else if m := reRespStatus.FindStringSubmatch(line); m != nil {
+			cur.status, _ = strconv.Atoi(m[1])
+		} else if m := reReqAcct.FindStringSubmatch(line); m != nil {
+			// ReqAcct: reqhdr reqbody reqtotal resphdr respbody resptotal;
+			// varnish_response_bytes tracks response body size, field 5 (m[5]).
+			n, _ := strconv.ParseInt(m[5], 10, 64)
+			cur.respBodyBytes = n
+		} else if m := reVCLCall.FindStringSubmatch(line); m != nil {
+			switch m[1] {
+			case "HIT", "MISS", "PASS", "HITPASS", "HITMISS":
+				cur.cacheResult = strings.ToLower(m[1])
+			}
+		} else if m := reHeader.FindStringSubmatch(line); m != nil {
+			if label, ok := c.labelWhitelist[strings.ToLower(strings.TrimSpace(m[1]))]; ok {
+				if cur.labels == nil {
+					cur.labels = map[string]string{}
+				}
+				cur.labels[label] = strings.TrimSpace(m[2])
+			}
+		}
+	}
+}
+
+func (c *vslCollector) flush(r *record) {
+	if r.status == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.resp > r.start && r.start > 0 {
+		c.reqDuration.observe(c.buckets, r.resp-r.start)
+	}
+	if r.berespB > r.bereq && r.bereq > 0 {
+		c.backendDuration.observe(c.buckets, r.berespB-r.bereq)
+	}
+	if r.respBodyBytes > 0 {
+		c.responseBytes.observe(c.buckets, float64(r.respBodyBytes))
+	}
+
+	class := fmt.Sprintf("%dxx", r.status/100)
+	c.statusClass.inc(class, r.labels)
+	if r.cacheResult != "" {
+		c.cacheResult.inc(r.cacheResult, r.labels)
+	}
+}
+
+// render writes the accumulated histograms/counters in the same hand-built
+// exposition format genMetrics uses for the varnishstat-derived metrics.
+func (c *vslCollector) render(w *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHistogram(w, "varnish_request_duration_seconds", "Request processing time, Timestamp Resp - Timestamp Start", c.buckets, c.reqDuration)
+	writeHistogram(w, "varnish_backend_duration_seconds", "Backend fetch time, Timestamp BerespBody - Timestamp Bereq", c.buckets, c.backendDuration)
+	writeHistogram(w, "varnish_response_bytes", "Response body size from ReqAcct", c.buckets, c.responseBytes)
+
+	w.WriteString("# HELP varnish_requests_by_status_total Completed requests by response status class\n")
+	w.WriteString("# TYPE varnish_requests_by_status_total counter\n")
+	writeLabeledCounter(w, "varnish_requests_by_status_total", "status", c.statusClass)
+
+	w.WriteString("# HELP varnish_requests_by_cache_result_total Completed requests by cache hit/miss/pass\n")
+	w.WriteString("# TYPE varnish_requests_by_cache_result_total counter\n")
+	writeLabeledCounter(w, "varnish_requests_by_cache_result_total", "result", c.cacheResult)
+}
+
+// writeLabeledCounter renders one labeledCounter's entries, combining the
+// counter's own dimension (labelName) with whatever whitelisted VSL
+// headers were extracted for that bucket.
+func writeLabeledCounter(w *bytes.Buffer, name, labelName string, lc *labeledCounter) {
+	for k, e := range lc.counts {
+		labelPairs := []string{fmt.Sprintf("%s=%q", labelName, k.value)}
+		names := make([]string, 0, len(e.labels))
+		for n := range e.labels {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			labelPairs = append(labelPairs, fmt.Sprintf("%s=%q", n, e.labels[n]))
+		}
+		w.WriteString(fmt.Sprintf("%s{%s} %d\n", name, strings.Join(labelPairs, ","), e.n))
+	}
+}
+
+// collectPrometheus is the typed-descriptor counterpart to render, used by
+// promCollector so -exposition=prometheus gets the same VSL-derived
+// histograms/counters as the legacy text path.
+func (c *vslCollector) collectPrometheus(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	emitHistogram(ch, c.reqDurationDesc, c.buckets, c.reqDuration)
+	emitHistogram(ch, c.backendDurationDesc, c.buckets, c.backendDuration)
+	emitHistogram(ch, c.responseBytesDesc, c.buckets, c.responseBytes)
+
+	emitLabeledCounter(ch, c.statusDesc, c.labelNames, c.statusClass)
+	emitLabeledCounter(ch, c.cacheResultDesc, c.labelNames, c.cacheResult)
+}
+
+func emitHistogram(ch chan<- prometheus.Metric, desc *prometheus.Desc, buckets []float64, h *histogram) {
+	bucketCounts := make(map[float64]uint64, len(buckets))
+	for i, le := range buckets {
+		bucketCounts[le] = h.counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(desc, h.count, h.sum, bucketCounts)
+}
+
+func emitLabeledCounter(ch chan<- prometheus.Metric, desc *prometheus.Desc, extraLabelNames []string, lc *labeledCounter) {
+	for k, e := range lc.counts {
+		values := make([]string, 0, len(extraLabelNames)+1)
+		values = append(values, k.value)
+		for _, name := range extraLabelNames {
+			values = append(values, e.labels[name])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(e.n), values...)
+	}
+}
+
+func writeHistogram(w *bytes.Buffer, name, help string, buckets []float64, h *histogram) {
+	w.WriteString(fmt.Sprintf("# HELP %s %s\n", name, help))
+	w.WriteString(fmt.Sprintf("# TYPE %s histogram\n", name))
+	for i, le := range buckets {
+		w.WriteString(fmt.Sprintf("%s_bucket{le=\"%g\"} %d\n", name, le, h.counts[i]))
+	}
+	w.WriteString(fmt.Sprintf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count))
+	w.WriteString(fmt.Sprintf("%s_sum %g\n", name, h.sum))
+	w.WriteString(fmt.Sprintf("%s_count %d\n", name, h.count))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// realVarnishlogTranscript is a trimmed `varnishlog -g request` transcript
+// (grouping marker + tag columns as Varnish actually emits them, not just
+// hand-indented tag names) for one completed request.
+const realVarnishlogTranscript = `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   Timestamp      Start: 1690000000.000000 0.000000 0.000000
+-   ReqMethod      GET
+-   ReqURL         /
+-   ReqProtocol    HTTP/1.1
+-   ReqHeader      Host: example.com
+-   VCL_call       RECV
+-   VCL_call       DELIVER
+-   RespProtocol   HTTP/1.1
+-   RespStatus     200
+-   RespReason     OK
+-   RespHeader     X-Cache: HIT
+-   RespHeader     Server: varnish
+-   Timestamp      Resp: 1690000000.100000 0.100000 0.050000
+-   ReqAcct        100 50 150 200 75 275
+-   End
+
+`
+
+func TestReReqAcctRespBodyBytesField(t *testing.T) {
+	m := reReqAcct.FindStringSubmatch("-   ReqAcct        100 50 150 200 75 275")
+	if m == nil {
+		t.Fatal("reReqAcct did not match a marker-prefixed ReqAcct line")
+	}
+	if got := m[5]; got != "75" {
+		t.Fatalf("m[5] = %q, want %q (response body bytes)", got, "75")
+	}
+}
+
+func TestTagRegexesIgnoreGroupingMarker(t *testing.T) {
+	cases := []struct {
+		name string
+		re   *regexp.Regexp
+		line string
+	}{
+		{"Timestamp Start", reTimestampStart, "-   Timestamp      Start: 1690000000.000000 0.000000 0.000000"},
+		{"Timestamp Resp", reTimestampResp, "-   Timestamp      Resp: 1690000000.100000 0.100000 0.050000"},
+		{"RespStatus", reRespStatus, "-   RespStatus     200"},
+		{"ReqAcct", reReqAcct, "-   ReqAcct        100 50 150 200 75 275"},
+		{"VCL_call", reVCLCall, "-   VCL_call       DELIVER"},
+		{"ReqHeader", reHeader, "-   ReqHeader      Host: example.com"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.re.FindStringSubmatch(c.line) == nil {
+				t.Errorf("%q did not match marker-prefixed line %q", c.re.String(), c.line)
+			}
+		})
+	}
+}
+
+func TestConsumeReaderExtractsWhitelistedLabels(t *testing.T) {
+	c := newVSLCollector([]string{"Host", "X-Cache"})
+
+	c.consumeReader(bufio.NewScanner(strings.NewReader(realVarnishlogTranscript)))
+
+	var got map[string]string
+	for _, e := range c.statusClass.counts {
+		got = e.labels
+	}
+	if got == nil {
+		t.Fatal("no statusClass entry recorded")
+	}
+	if got["host"] != "example.com" {
+		t.Errorf("host label = %q, want %q", got["host"], "example.com")
+	}
+	if got["x_cache"] != "HIT" {
+		t.Errorf("x_cache label = %q, want %q", got["x_cache"], "HIT")
+	}
+	if _, ok := got["server"]; ok {
+		t.Error("Server header extracted despite not being whitelisted")
+	}
+}
+
+func TestConsumeReaderRecordsDurationAndResponseBytes(t *testing.T) {
+	c := newVSLCollector(nil)
+
+	c.consumeReader(bufio.NewScanner(strings.NewReader(realVarnishlogTranscript)))
+
+	if c.reqDuration.count != 1 {
+		t.Fatalf("reqDuration.count = %d, want 1", c.reqDuration.count)
+	}
+	if got, want := c.reqDuration.sum, 0.1; math.Abs(got-want) > 1e-6 {
+		t.Errorf("reqDuration.sum = %v, want %v", got, want)
+	}
+	if c.responseBytes.count != 1 {
+		t.Fatalf("responseBytes.count = %d, want 1", c.responseBytes.count)
+	}
+	if got, want := c.responseBytes.sum, 75.0; got != want {
+		t.Errorf("responseBytes.sum = %v, want %v", got, want)
+	}
+}
+
+func TestFlushObservesResponseBodyBytes(t *testing.T) {
+	c := newVSLCollector(nil)
+	c.flush(&record{status: 200, respBodyBytes: 75})
+
+	if c.responseBytes.count != 1 {
+		t.Fatalf("responseBytes.count = %d, want 1", c.responseBytes.count)
+	}
+	if c.responseBytes.sum != 75 {
+		t.Fatalf("responseBytes.sum = %v, want 75", c.responseBytes.sum)
+	}
+}
@@ -0,0 +1,167 @@
+//go:build vsm
+
+// The vsm build tag gates everything in this file: it cgo-imports Varnish's
+// own vapi/vsm.h and vapi/vsc.h and links -lvarnishapi, so building it
+// requires libvarnishapi-dev on the build machine. Default builds (no
+// -tags vsm) use stats_vsm_stub.go instead, which needs no C toolchain and
+// just rejects -collector=vsm with an explanatory error.
+package main
+
+/*
+#cgo LDFLAGS: -lvarnishapi
+#include <stdlib.h>
+#include <vapi/vsm.h>
+#include <vapi/vsc.h>
+
+extern void goVSCIter(void *priv, char *name, int flag, char *desc, int64_t value);
+
+static int vsc_iter_cb(void *priv, const struct vsc_point *pt) {
+	goVSCIter(priv, (char *)pt->name, pt->flag, (char *)pt->sdesc, *(const volatile uint64_t *)pt->ptr);
+	return 0;
+}
+
+static int vsc_iterate(struct vsc *vsc, struct vsm *vsm, void *priv) {
+	return VSC_Iter(vsc, vsm, vsc_iter_cb, priv);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/valyala/fastjson"
+)
+
+// vsmStatsCollector keeps a VSM segment mapped for the lifetime of the
+// exporter and reads VSC counters straight out of shared memory, avoiding
+// the fork+exec cost of varnishstat on every scrape. Varnish can abandon
+// the segment (restart, or the child holding it dies); Collect detects
+// that and re-opens transparently.
+type vsmStatsCollector struct {
+	mu   sync.Mutex
+	name string
+	vsm  *C.struct_vsm
+	vsc  *C.struct_vsc
+}
+
+func newVSMStatsCollector(instanceName string) (*vsmStatsCollector, error) {
+	c := &vsmStatsCollector{name: instanceName}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *vsmStatsCollector) open() error {
+	vsm := C.VSM_New()
+	if vsm == nil {
+		return errors.New("vsm: VSM_New failed")
+	}
+	if c.name != "" {
+		cname := C.CString(c.name)
+		defer C.free(unsafe.Pointer(cname))
+		if C.VSM_n_Arg(vsm, cname) < 0 {
+			C.VSM_Delete(vsm)
+			return fmt.Errorf("vsm: invalid instance name %q", c.name)
+		}
+	}
+	if C.VSM_Attach(vsm, 2, nil) != 0 {
+		C.VSM_Delete(vsm)
+		return errors.New("vsm: attach failed")
+	}
+	vsc := C.VSC_New()
+	if vsc == nil {
+		C.VSM_Delete(vsm)
+		return errors.New("vsm: VSC_New failed")
+	}
+	c.vsm = vsm
+	c.vsc = vsc
+	return nil
+}
+
+// reopen is called when Collect hits an abandoned segment so a Varnish
+// restart does not require restarting the exporter.
+func (c *vsmStatsCollector) reopen() error {
+	c.closeLocked()
+	return c.open()
+}
+
+func (c *vsmStatsCollector) closeLocked() {
+	if c.vsc != nil {
+		C.VSC_Destroy(&c.vsc, c.vsm)
+		c.vsc = nil
+	}
+	if c.vsm != nil {
+		C.VSM_Delete(c.vsm)
+		c.vsm = nil
+	}
+}
+
+type vscIterResult struct {
+	arena *fastjson.Arena
+	obj   *fastjson.Object
+	err   error
+}
+
+var vscIterState sync.Map // map[unsafe.Pointer]*vscIterResult, keyed by priv token
+
+func (c *vsmStatsCollector) Collect() (*fastjson.Object, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	obj, err := c.collectLocked()
+	if err != nil && C.VSM_StillValid(c.vsm, nil) == C.vsm_vsm_abandoned {
+		if rerr := c.reopen(); rerr != nil {
+			return nil, rerr
+		}
+		obj, err = c.collectLocked()
+	}
+	return obj, err
+}
+
+func (c *vsmStatsCollector) collectLocked() (*fastjson.Object, error) {
+	arena := &fastjson.Arena{}
+	res := &vscIterResult{arena: arena, obj: arena.NewObject().GetObject()}
+
+	token := new(byte)
+	priv := unsafe.Pointer(token)
+	vscIterState.Store(priv, res)
+	defer vscIterState.Delete(priv)
+
+	if rv := C.vsc_iterate(c.vsc, c.vsm, priv); rv != 0 {
+		return nil, fmt.Errorf("vsm: VSC_Iter returned %d", int(rv))
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res.obj, nil
+}
+
+//export goVSCIter
+func goVSCIter(priv unsafe.Pointer, name *C.char, flag C.int, desc *C.char, value C.int64_t) {
+	v, ok := vscIterState.Load(priv)
+	if !ok {
+		return
+	}
+	res := v.(*vscIterResult)
+
+	entry := res.arena.NewObject()
+	entry.Set("value", res.arena.NewNumberInt(int(value)))
+	entry.Set("flag", res.arena.NewString(string(rune(flag))))
+	entry.Set("description", res.arena.NewString(C.GoString(desc)))
+	res.obj.Set(C.GoString(name), entry)
+}
+
+func newStatsCollector(kind, instanceName string) (statsCollector, error) {
+	switch kind {
+	case "", "exec":
+		return execStatsCollector{instanceName: instanceName}, nil
+	case "vsm":
+		return newVSMStatsCollector(instanceName)
+	default:
+		return nil, fmt.Errorf("unknown -collector %q, want exec|vsm", kind)
+	}
+}